@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// debugLogLines is how many trailing lines of git output /debug/{name} keeps
+// around per repo.
+const debugLogLines = 200
+
+// run starts the per-repo sync loops and the status/tickle http server, and
+// blocks until SIGTERM or SIGINT, at which point it waits for any in-flight
+// fetches to finish before returning.
+func (m *mirror) run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:    *flagAddr,
+		Handler: m.handler(),
+	}
+
+	srvErr := make(chan error, 1)
+	go func() {
+		log.Printf("serving status/tickle endpoints on %s", *flagAddr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			srvErr <- err
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.queue.run(ctx, *flagSyncWorkers, m.processSyncRequest)
+	}()
+
+	for _, r := range m.repos {
+		wg.Add(1)
+		go func(r *repo) {
+			defer wg.Done()
+			r.loop(ctx, *flagMaxInterval)
+		}(r)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.healthcheckLoop(ctx, *flagHealthInterval)
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down, waiting for in-flight syncs")
+	case err := <-srvErr:
+		stop()
+		return err
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("error shutting down http server: %v", err)
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// loop enqueues a full sync for r once immediately and then again every
+// maxInterval, for as long as ctx is alive. It's the periodic half of
+// scheduling; handleRepoTickle is the on-demand half. Both go through
+// enqueueSync, which is what actually talks to the syncQueue.
+func (r *repo) loop(ctx context.Context, maxInterval time.Duration) {
+	r.enqueueSync(SyncFull)
+
+	ticker := time.NewTicker(maxInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.enqueueSync(SyncFull)
+		}
+	}
+}
+
+// enqueueSync submits a sync request of the given kind for r to the queue,
+// coalescing requests that land less than flagMinInterval after the
+// previous one.
+func (r *repo) enqueueSync(kind SyncKind) {
+	r.enqueueMu.Lock()
+	defer r.enqueueMu.Unlock()
+
+	if time.Since(r.lastEnqueued) < *flagMinInterval {
+		log.Printf("coalescing sync request for repo: %s", r.name)
+		return
+	}
+
+	if err := r.queue.Enqueue(SyncRequest{RepoName: r.name, Kind: kind}); err != nil {
+		log.Printf("error enqueuing sync for repo: %s, err: %v", r.name, err)
+		return
+	}
+
+	r.lastEnqueued = time.Now()
+}
+
+// processSyncRequest runs one SyncRequest popped off the queue. It's the
+// handler passed to syncQueue.run.
+func (m *mirror) processSyncRequest(req SyncRequest) error {
+	r := m.findRepo(req.RepoName)
+	if r == nil {
+		return fmt.Errorf("unknown repo: %s", req.RepoName)
+	}
+
+	return r.sync(req.Kind)
+}
+
+func (m *mirror) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", m.handleIndex)
+	mux.HandleFunc("/repo/", m.handleRepoTickle)
+	mux.HandleFunc("/debug/", m.handleDebug)
+	mux.HandleFunc("/health", m.handleHealth)
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+func (m *mirror) findRepo(name string) *repo {
+	for _, r := range m.repos {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// handleIndex serves GET / with every repo's name, last-fetch time,
+// last-push time, last error, current state, and health (degraded/last
+// check), so an operator doesn't have to separately hit /health to see
+// which mirrors need attention.
+func (m *mirror) handleIndex(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, r := range m.repos {
+		s := r.status.snapshot()
+		h := r.health.snapshot()
+		fmt.Fprintf(w, "%s\tstate=%s\tlast_fetch=%s\tlast_push=%s\tlast_err=%v\tdegraded=%t\tlast_health_check=%s\n",
+			r.name, s.state, formatTime(s.lastFetch), formatTime(s.lastPush), s.lastErr,
+			h.degraded, formatTime(h.lastCheck))
+	}
+}
+
+// handleRepoTickle serves POST /repo/{name}/tickle. A tickle only asks for a
+// fresh fetch from source (SyncPull) - the periodic loop is what keeps
+// destinations up to date (SyncFull), so there's no need for a tickle to
+// wait on a push too.
+func (m *mirror) handleRepoTickle(w http.ResponseWriter, req *http.Request) {
+	name, rest, ok := cutPath(req.URL.Path, "/repo/")
+	if !ok || rest != "tickle" {
+		http.NotFound(w, req)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r := m.findRepo(name)
+	if r == nil {
+		http.Error(w, "unknown repo", http.StatusNotFound)
+		return
+	}
+
+	r.enqueueSync(SyncPull)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleDebug serves GET /debug/{name} with the last debugLogLines lines of
+// git stdout/stderr for that repo.
+func (m *mirror) handleDebug(w http.ResponseWriter, req *http.Request) {
+	name, rest, ok := cutPath(req.URL.Path, "/debug/")
+	if !ok || rest != "" {
+		http.NotFound(w, req)
+		return
+	}
+
+	r := m.findRepo(name)
+	if r == nil {
+		http.Error(w, "unknown repo", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range r.output.lines() {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// handleHealth serves GET /health with every repo's last fsck/gc check time,
+// whether it's degraded, and the error that degraded it, if any.
+func (m *mirror) handleHealth(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/health" {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, r := range m.repos {
+		h := r.health.snapshot()
+		fmt.Fprintf(w, "%s\tdegraded=%t\tlast_check=%s\tlast_err=%v\n",
+			r.name, h.degraded, formatTime(h.lastCheck), h.lastErr)
+	}
+}
+
+// cutPath splits a URL path of the form prefix+"name"+"/"+rest. ok is false
+// if path doesn't start with prefix or has no name component.
+func cutPath(path, prefix string) (name, rest string, ok bool) {
+	trimmed := strings.TrimPrefix(path, prefix)
+	if trimmed == path {
+		return "", "", false
+	}
+
+	name, rest, found := strings.Cut(trimmed, "/")
+	if !found {
+		return trimmed, "", trimmed != ""
+	}
+	return name, rest, name != ""
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// repoStatus is a repo's current scheduling/sync state, safe for concurrent
+// access by the sync loop and the status http handlers.
+type repoStatus struct {
+	mu        sync.Mutex
+	state     string
+	lastFetch time.Time
+	lastPush  time.Time
+	lastErr   error
+}
+
+type repoStatusSnapshot struct {
+	state     string
+	lastFetch time.Time
+	lastPush  time.Time
+	lastErr   error
+}
+
+func (s *repoStatus) recordFetch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastFetch = time.Now()
+	s.state = "idle"
+	s.lastErr = nil
+}
+
+func (s *repoStatus) recordPush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPush = time.Now()
+	s.state = "idle"
+	s.lastErr = nil
+}
+
+func (s *repoStatus) recordErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = "error"
+	s.lastErr = err
+}
+
+func (s *repoStatus) snapshot() repoStatusSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return repoStatusSnapshot{
+		state:     s.state,
+		lastFetch: s.lastFetch,
+		lastPush:  s.lastPush,
+		lastErr:   s.lastErr,
+	}
+}
+
+// logRing keeps the last N lines written to it, for the /debug/{name}
+// endpoint to dump.
+type logRing struct {
+	mu  sync.Mutex
+	buf []string
+	max int
+}
+
+func newLogRing(max int) *logRing {
+	return &logRing{max: max}
+}
+
+func (l *logRing) append(out []byte) {
+	if len(out) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		l.buf = append(l.buf, scanner.Text())
+	}
+
+	if len(l.buf) > l.max {
+		l.buf = l.buf[len(l.buf)-l.max:]
+	}
+}
+
+func (l *logRing) lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]string, len(l.buf))
+	copy(out, l.buf)
+	return out
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+)
+
+// git runs one git invocation with dir as its working directory (empty for
+// none, e.g. clone's destination is passed as an argument instead), under
+// flagGitTimeout, using flagGitBinary and flagSSHKey. It's the single choke
+// point every git invocation in this package goes through, which is what
+// makes it possible to point the whole program at a fake git binary and a
+// file:// upstream in tests.
+func (m *mirror) git(ctx context.Context, dir string, args ...string) (stdout, stderr []byte, err error) {
+	ctx, cancel := context.WithTimeout(ctx, *flagGitTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, *flagGitBinary, args...)
+	cmd.Dir = dir
+
+	// Keep git from ever blocking on a credential/passphrase prompt, and
+	// don't let a machine-wide gitconfig change how these invocations behave.
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_CONFIG_NOSYSTEM=1",
+	)
+	if *flagSSHKey != "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND=ssh -i "+*flagSSHKey+" -o IdentitiesOnly=yes")
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	cmd.Stdout = &stdoutBuf
+	cmd.Stderr = &stderrBuf
+
+	err = cmd.Run()
+
+	return stdoutBuf.Bytes(), stderrBuf.Bytes(), err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthcheckLoop runs a git fsck + git gc pass over every repo on a fixed
+// interval, for as long as ctx is alive. Long-lived mirror clones otherwise
+// accumulate cruft, and occasionally end up with stale lock files or
+// corrupt packfiles that make every future fetch fail.
+func (m *mirror) healthcheckLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, r := range m.repos {
+				r.healthcheck()
+			}
+		}
+	}
+}
+
+// healthcheck sweeps stale lock files, then runs git fsck and git gc. If
+// fsck reports corruption, the repo is wiped and a fresh clone is enqueued
+// rather than trying to repair it in place.
+//
+// healthcheck holds r.syncMu for its entire duration, the same lock sync
+// takes, so it never runs fsck/gc - or, worse, os.RemoveAll - against a root
+// a queue worker is mid-fetch/push on.
+func (r *repo) healthcheck() {
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+
+	r.sweepStaleLocks()
+
+	log.Printf("healthcheck: running git fsck on repo: %s", r.name)
+	stdout, stderr, err := r.mirror.git(context.Background(), r.root, "fsck", "--no-dangling")
+	r.output.append(stdout)
+	r.output.append(stderr)
+	if err != nil {
+		log.Printf("healthcheck: repo %s failed git fsck, marking for reclone: %v", r.name, err)
+		r.health.recordDegraded(err)
+
+		os.RemoveAll(r.root)
+		if err := r.queue.Enqueue(SyncRequest{RepoName: r.name, Kind: SyncFull}); err != nil {
+			log.Printf("healthcheck: error enqueuing reclone for repo %s: %v", r.name, err)
+		}
+		return
+	}
+
+	log.Printf("healthcheck: running git gc on repo: %s", r.name)
+	gcStdout, gcStderr, gcErr := r.mirror.git(context.Background(), r.root, "gc", "--auto", "--prune=now")
+	r.output.append(gcStdout)
+	r.output.append(gcStderr)
+	if gcErr != nil {
+		log.Printf("healthcheck: repo %s failed git gc: %v", r.name, gcErr)
+		r.health.recordDegraded(gcErr)
+		return
+	}
+
+	r.health.recordHealthy()
+}
+
+// sweepStaleLocks deletes *.lock files (index.lock, shallow.lock, etc) left
+// behind by a git process that died mid-operation, once they're older than
+// flagGitTimeout - any operation still legitimately holding one would have
+// finished or been killed by its own timeout by then.
+func (r *repo) sweepStaleLocks() {
+	cutoff := time.Now().Add(-*flagGitTimeout)
+
+	err := filepath.WalkDir(r.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		log.Printf("healthcheck: removing stale lock file: %s", path)
+		if err := os.Remove(path); err != nil {
+			log.Printf("healthcheck: error removing stale lock file %s: %v", path, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("healthcheck: error walking repo %s for stale locks: %v", r.name, err)
+	}
+}
+
+// repoHealth is the result of the most recent healthcheck for a repo, safe
+// for concurrent access by the healthcheck loop and the /health handler.
+type repoHealth struct {
+	mu        sync.Mutex
+	lastCheck time.Time
+	degraded  bool
+	lastErr   error
+}
+
+type repoHealthSnapshot struct {
+	lastCheck time.Time
+	degraded  bool
+	lastErr   error
+}
+
+func (h *repoHealth) recordHealthy() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCheck = time.Now()
+	h.degraded = false
+	h.lastErr = nil
+}
+
+func (h *repoHealth) recordDegraded(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCheck = time.Now()
+	h.degraded = true
+	h.lastErr = err
+}
+
+func (h *repoHealth) snapshot() repoHealthSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return repoHealthSnapshot{
+		lastCheck: h.lastCheck,
+		degraded:  h.degraded,
+		lastErr:   h.lastErr,
+	}
+}
@@ -1,51 +1,108 @@
 package main
 
 import (
-	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
-// read mapping yaml from ado to bitbucket
+// read mapping yaml from a source to one or more destinations
 // - name: reponame
 //   ado: repo url ssh
-//   bitbucket: repo url ssh
+//   destinations:
+//     - name: bitbucket
+//       kind: bitbucket
+//       url: repo url ssh
+//     - name: github
+//       kind: github
+//       url: repo url ssh
+//       enabled: false
 
 type mirror struct {
-	repos    []repo
+	repos    []*repo
 	cacheDir string
+	queue    *syncQueue
 }
 
 type repo struct {
-	root        string // root on disk cachedir+name
-	name        string // name of repo from yaml file
-	source      string // source url from yaml file
-	destination string // destination url from yaml file
+	root         string        // root on disk cachedir+name
+	name         string        // name of repo from yaml file
+	source       string        // source url from yaml file
+	destinations []destination // destinations to mirror to
+
+	mirror *mirror    // back-reference, used to reach mirror.git()
+	queue  *syncQueue // shared with mirror, used by enqueueSync
+
+	enqueueMu    sync.Mutex
+	lastEnqueued time.Time // last time a sync was enqueued, for coalescing
+
+	// syncMu serializes every git operation against root: sync (fetch/push)
+	// and healthcheck (fsck/gc) both run from their own goroutines and must
+	// never touch the same working copy at once, or they risk corrupting it.
+	syncMu sync.Mutex
+
+	status repoStatus
+	health repoHealth
+	output *logRing // last N lines of git stdout/stderr, for /debug/{name}
 }
 
+// destination is a single place a repo gets mirrored to. name is used
+// verbatim as the remote name under remotes/ and as the git remote name
+// passed to push, so it must be deterministic and filesystem/remote safe -
+// it comes from the yaml config rather than being derived from the URL.
+type destination struct {
+	name     string
+	kind     string // e.g. "bitbucket", "github" - descriptive only, not read anywhere yet
+	url      string
+	refspecs []string // push refspecs, defaults to heads+tags when empty
+	enabled  bool
+}
+
+var defaultRefspecs = []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+
 type Repos struct {
 	Repos []RepoMap `yaml:"repos"`
 }
 
 type RepoMap struct {
-	Name      string `yaml:"name"`
-	ADO       string `yaml:"ado"`
-	BitBucket string `yaml:"bb"`
+	Name         string           `yaml:"name"`
+	ADO          string           `yaml:"ado"`
+	Destinations []DestinationMap `yaml:"destinations"`
+}
+
+// DestinationMap is one entry in a RepoMap's destinations list.
+type DestinationMap struct {
+	Name     string   `yaml:"name"`
+	Kind     string   `yaml:"kind"` // e.g. "bitbucket", "github", "mirror"
+	URL      string   `yaml:"url"`
+	Refspecs []string `yaml:"refspecs"`
+	Enabled  *bool    `yaml:"enabled"` // defaults to true when unset
 }
 
 var (
 	flagCacheDir     = flag.String("cachedir", "", "git cache directory")
 	repoMappingsFile = flag.String("repomappingsfile", "repos.yaml", "file with repo  mappings")
 	flagMirror       = flag.Bool("mirror", false, "enable mirroring to other repos")
+
+	flagAddr        = flag.String("addr", ":8080", "address to serve the status/tickle/metrics http endpoints on")
+	flagMinInterval = flag.Duration("mininterval", 30*time.Second, "minimum time between fetches of a repo")
+	flagMaxInterval = flag.Duration("maxinterval", 10*time.Minute, "maximum time between fetches of a repo")
+
+	flagSyncWorkers     = flag.Int("syncworkers", 5, "number of workers processing the sync queue")
+	flagMaxSyncAttempts = flag.Int("maxsyncattempts", 8, "max attempts for a sync request before it's dropped")
+
+	flagHealthInterval = flag.Duration("healthinterval", 24*time.Hour, "interval between git fsck/gc health checks of each repo")
+
+	flagGitBinary  = flag.String("git-binary", "git", "path to the git binary to invoke")
+	flagSSHKey     = flag.String("ssh-key", "", "ssh private key for GIT_SSH_COMMAND, if source/destinations use ssh urls")
+	flagGitTimeout = flag.Duration("gittimeout", 30*time.Second, "timeout for a single git invocation (clone/fetch/push/fsck/gc)")
 )
 
 func main() {
@@ -60,7 +117,6 @@ func main() {
 		log.Fatalf("error create cache dir: %v", err)
 	}
 	log.Printf("created cacheDir: %s", cacheDir)
-	_ = cacheDir
 
 	repoMappingfilebytes, err := os.ReadFile(*repoMappingsFile)
 	if err != nil {
@@ -73,29 +129,59 @@ func main() {
 	if err != nil {
 		log.Fatalf("error unmarshaling repomappingsfile: %v", err)
 	}
-	log.Printf("read repoMappingsFile: %s", *repoMappingsFile)
 
-	re := []repo{}
-	_ = re
+	queue, err := openSyncQueue(filepath.Join(cacheDir, "syncqueue.db"), *flagMaxSyncAttempts)
+	if err != nil {
+		log.Fatalf("error opening sync queue: %v", err)
+	}
+	defer queue.Close()
+
+	re := []*repo{}
 	for _, r := range repos.Repos {
-		newRepo := repo{
-			root:        filepath.Join(cacheDir, r.Name),
-			name:        r.Name,
-			source:      r.ADO,
-			destination: r.BitBucket,
+		dests := make([]destination, 0, len(r.Destinations))
+		for _, d := range r.Destinations {
+			enabled := true
+			if d.Enabled != nil {
+				enabled = *d.Enabled
+			}
+
+			refspecs := d.Refspecs
+			if len(refspecs) == 0 {
+				refspecs = defaultRefspecs
+			}
+
+			dests = append(dests, destination{
+				name:     d.Name,
+				kind:     d.Kind,
+				url:      d.URL,
+				refspecs: refspecs,
+				enabled:  enabled,
+			})
+		}
+
+		newRepo := &repo{
+			root:         filepath.Join(cacheDir, r.Name),
+			name:         r.Name,
+			source:       r.ADO,
+			destinations: dests,
+			queue:        queue,
+			output:       newLogRing(debugLogLines),
 		}
 		re = append(re, newRepo)
 	}
 
-	mirror := &mirror{
+	m := &mirror{
 		repos:    re,
 		cacheDir: cacheDir,
+		queue:    queue,
+	}
+	for _, r := range re {
+		r.mirror = m
 	}
 
-	mirror.initRepos()
-
-	_ = mirror
-	// fmt.Printf("%v\n", repos)
+	if err := m.run(); err != nil {
+		log.Fatalf("error running mirror: %v", err)
+	}
 }
 
 func createCacheDir() (string, error) {
@@ -124,124 +210,3 @@ func createCacheDir() (string, error) {
 
 	return *flagCacheDir, nil
 }
-
-func (m *mirror) initRepos() {
-	const max = 5
-
-	c := make(chan repo)
-	for i := 0; i < max; i++ {
-		go func(rc chan repo) {
-			for r := range rc {
-				canReuse := true
-
-				_, err := os.Stat(filepath.Join(r.root, "FETCH_HEAD"))
-				if err != nil {
-					canReuse = false
-					log.Printf("can't resuse repo: %s", r.root)
-				}
-
-				if canReuse {
-					log.Printf("trying to resuse repo: %s", r.root)
-					fetch(r)
-					if err != nil {
-						canReuse = false
-						log.Printf("failed to resuse repo: %s", r.root)
-					}
-				}
-
-				if !canReuse {
-					os.RemoveAll(r.root)
-					clone(r)
-				}
-
-				// we want to be able to reuse even if we don't mirror
-				fetch(r)
-
-				if *flagMirror {
-					addRemote(r)
-					push(r)
-				}
-			}
-		}(c)
-	}
-
-	for _, r := range m.repos {
-		c <- r
-	}
-
-	close(c)
-}
-
-func clone(r repo) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	log.Printf("cloning repo: %s, root: %s", r.name, r.root)
-	cmd := exec.CommandContext(ctx, "git", "clone", "--mirror", r.source, r.root)
-
-	if err := cmd.Start(); err != nil {
-		log.Printf("error starting git clone on repo: %s, err: %v", r.name, err)
-	}
-
-	if err := cmd.Wait(); err != nil {
-		log.Printf("error waiting git clone on repo: %s, err: %v", r.name, err)
-	}
-}
-
-func addRemote(r repo) {
-	if err := os.MkdirAll(filepath.Join(r.root, "remotes"), 0777); err != nil {
-		return
-	}
-
-	// We want to include only the refs/heads/* and refs/tags/* namespaces
-	// in the mirrors. They correspond to published branches and tags.
-	remote := "URL: " + r.destination + "\n" +
-		"Push: +refs/heads/*:refs/heads/*\n" +
-		"Push: +refs/tags/*:refs/tags/*\n"
-
-	nameAt := strings.Split(r.destination, "@")
-	name := strings.Split(nameAt[1], ":")[0]
-
-	ioutil.WriteFile(filepath.Join(r.root, "remotes", name), []byte(remote), 0777)
-}
-
-func fetch(r repo) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	log.Printf("fetching repo: %s, root: %s", r.name, r.root)
-	cmd := exec.CommandContext(ctx, "git", "fetch", "--prune", "origin")
-	cmd.Dir = r.root
-
-	if err := cmd.Start(); err != nil {
-		log.Printf("error starting git fetch on repo: %s, err: %v", r.name, err)
-		return err
-	}
-
-	if err := cmd.Wait(); err != nil {
-		log.Printf("error waiting git fetch on repo: %s, err: %v", r.name, err)
-		return err
-	}
-
-	return nil
-}
-
-func push(r repo) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	nameAt := strings.Split(r.destination, "@")
-	name := strings.Split(nameAt[1], ":")[0]
-
-	log.Printf("pushing repo: %s, root: %s", r.name, r.root)
-	cmd := exec.CommandContext(ctx, "git", "push", "--mirror", "--force", name)
-	cmd.Dir = r.root
-
-	if err := cmd.Start(); err != nil {
-		log.Printf("error starting git push on repo: %s, err: %v", r.name, err)
-	}
-
-	if err := cmd.Wait(); err != nil {
-		log.Printf("error waiting git push on repo: %s, err: %v", r.name, err)
-	}
-}
@@ -0,0 +1,24 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	syncAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gitmirror_sync_attempts_total",
+		Help: "Total number of sync requests popped off the queue and attempted, by repo and kind.",
+	}, []string{"repo", "kind"})
+
+	syncFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gitmirror_sync_failures_total",
+		Help: "Total number of sync attempts that failed, by repo and kind.",
+	}, []string{"repo", "kind"})
+
+	syncQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gitmirror_sync_queue_depth",
+		Help: "Number of sync requests currently pending in the queue, including ones waiting out a backoff.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(syncAttemptsTotal, syncFailuresTotal, syncQueueDepth)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// sync brings r's local mirror up to date with its source (SyncPull,
+// SyncFull) and, if mirroring is enabled, pushes it out to every enabled
+// destination (SyncFull). It is the unit of work a syncQueue worker performs
+// for one SyncRequest, and its returned error drives the queue's retry/backoff.
+//
+// sync holds r.syncMu for its entire duration, so it never runs concurrently
+// with another sync or a healthcheck on the same repo - two workers racing a
+// fetch/push against one bare mirror clone is a real corruption risk, not
+// just a theoretical one.
+func (r *repo) sync(kind SyncKind) error {
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+
+	if kind == SyncPull || kind == SyncFull {
+		if err := r.reuseOrClone(); err != nil {
+			return err
+		}
+	}
+
+	if kind == SyncFull && *flagMirror {
+		if err := r.addRemote(); err != nil {
+			log.Printf("error adding remotes for repo: %s, err: %v", r.name, err)
+			r.status.recordErr(err)
+			return err
+		}
+
+		attempted, errs := r.push()
+		if len(errs) > 0 {
+			for _, err := range errs {
+				log.Printf("error pushing repo: %s, err: %v", r.name, err)
+			}
+			err := errs[0]
+			r.status.recordErr(err)
+			return err
+		}
+
+		if attempted > 0 {
+			r.status.recordPush()
+		} else {
+			log.Printf("no enabled destinations for repo: %s, nothing pushed", r.name)
+		}
+	}
+
+	return nil
+}
+
+// reuseOrClone fetches into the existing cache dir if it looks usable, or
+// wipes it and clones fresh otherwise.
+func (r *repo) reuseOrClone() error {
+	canReuse := true
+
+	if _, err := os.Stat(filepath.Join(r.root, "FETCH_HEAD")); err != nil {
+		canReuse = false
+		log.Printf("can't resuse repo: %s", r.root)
+	}
+
+	if canReuse {
+		log.Printf("trying to resuse repo: %s", r.root)
+		if err := r.fetch(); err != nil {
+			canReuse = false
+			log.Printf("failed to resuse repo: %s", r.root)
+		}
+	}
+
+	if !canReuse {
+		os.RemoveAll(r.root)
+		r.clone()
+
+		// clone leaves the repo freshly fetched, but run fetch again so a
+		// reclone reports the same state a reuse would have.
+		return r.fetch()
+	}
+
+	return nil
+}
+
+func (r *repo) clone() {
+	log.Printf("cloning repo: %s, root: %s", r.name, r.root)
+
+	stdout, stderr, err := r.mirror.git(context.Background(), "", "clone", "--mirror", r.source, r.root)
+	r.output.append(stdout)
+	r.output.append(stderr)
+	if err != nil {
+		log.Printf("error running git clone on repo: %s, err: %v", r.name, err)
+		r.status.recordErr(err)
+	}
+}
+
+func (r *repo) addRemote() error {
+	if err := os.MkdirAll(filepath.Join(r.root, "remotes"), 0777); err != nil {
+		return err
+	}
+
+	for _, d := range r.destinations {
+		if !d.enabled {
+			continue
+		}
+
+		// We want to include only the namespaces given by the destination's
+		// refspecs (by default refs/heads/* and refs/tags/*, which
+		// correspond to published branches and tags) in the mirror.
+		remote := "URL: " + d.url + "\n"
+		for _, refspec := range d.refspecs {
+			remote += "Push: " + refspec + "\n"
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(r.root, "remotes", d.name), []byte(remote), 0777); err != nil {
+			return fmt.Errorf("writing remote file for destination %q: %v", d.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *repo) fetch() error {
+	log.Printf("fetching repo: %s, root: %s", r.name, r.root)
+
+	stdout, stderr, err := r.mirror.git(context.Background(), r.root, "fetch", "--prune", "origin")
+	r.output.append(stdout)
+	r.output.append(stderr)
+	if err != nil {
+		log.Printf("error running git fetch on repo: %s, err: %v", r.name, err)
+		r.status.recordErr(err)
+		return err
+	}
+
+	r.status.recordFetch()
+	return nil
+}
+
+// push mirrors r to each of its enabled destinations, continuing past
+// failures so that one bad destination doesn't block the others. It returns
+// the number of destinations actually attempted, and one error per failed
+// destination - attempted is 0 when every destination is disabled (or there
+// are none), which the caller needs to distinguish from a successful push.
+func (r *repo) push() (attempted int, errs []error) {
+	for _, d := range r.destinations {
+		if !d.enabled {
+			continue
+		}
+		attempted++
+
+		if err := r.pushDestination(d); err != nil {
+			errs = append(errs, fmt.Errorf("destination %q: %v", d.name, err))
+		}
+	}
+
+	return attempted, errs
+}
+
+func (r *repo) pushDestination(d destination) error {
+	log.Printf("pushing repo: %s, root: %s, destination: %s", r.name, r.root, d.name)
+
+	stdout, stderr, err := r.mirror.git(context.Background(), r.root, "push", "--mirror", "--force", d.name)
+	r.output.append(stdout)
+	r.output.append(stderr)
+	if err != nil {
+		log.Printf("error running git push on repo: %s, destination: %s, err: %v", r.name, d.name, err)
+		return err
+	}
+
+	return nil
+}
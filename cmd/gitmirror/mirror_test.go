@@ -0,0 +1,271 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runGit runs a git command for test setup/assertions and fails the test on
+// error. It does not go through (*mirror).git, since it's scaffolding
+// rather than something the test is exercising.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s (dir %s): %v\n%s", strings.Join(args, " "), dir, err, out)
+	}
+	return string(out)
+}
+
+// newBareRepo creates an empty bare repo under t.TempDir() and returns its
+// path, suitable for use as a file:// source or destination.
+func newBareRepo(t *testing.T, name string) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), name)
+	runGit(t, "", "init", "--bare", dir)
+	return dir
+}
+
+// seedCommit clones repoPath into a scratch worktree, commits a file, and
+// pushes it back, so repoPath (a bare repo) ends up with one more commit.
+func seedCommit(t *testing.T, repoPath, branch, file, contents string) {
+	t.Helper()
+
+	work := t.TempDir()
+	runGit(t, "", "clone", repoPath, work)
+
+	// Base the branch on the remote's existing copy of it, if any, so a
+	// second seedCommit on the same branch adds a commit instead of
+	// silently forking an unrelated history.
+	verify := exec.Command("git", "rev-parse", "--verify", "refs/remotes/origin/"+branch)
+	verify.Dir = work
+	if verify.Run() == nil {
+		runGit(t, work, "checkout", "-B", branch, "origin/"+branch)
+	} else {
+		runGit(t, work, "checkout", "-B", branch)
+	}
+
+	runGit(t, work, "config", "user.email", "test@example.com")
+	runGit(t, work, "config", "user.name", "test")
+
+	if err := writeFile(filepath.Join(work, file), contents); err != nil {
+		t.Fatalf("writing seed file: %v", err)
+	}
+
+	runGit(t, work, "add", file)
+	runGit(t, work, "commit", "-m", "seed commit on "+branch)
+	runGit(t, work, "push", "origin", branch)
+}
+
+func writeFile(path, contents string) error {
+	return os.WriteFile(path, []byte(contents), 0644)
+}
+
+// refs returns the set of ref names a bare repo currently has.
+func refs(t *testing.T, repoPath string) map[string]bool {
+	t.Helper()
+
+	out := runGit(t, repoPath, "for-each-ref", "--format=%(refname)")
+	set := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line != "" {
+			set[line] = true
+		}
+	}
+	return set
+}
+
+// newTestRepo wires up a *repo and its owning *mirror, pointed at source,
+// with destination registered and enabled (sync only pushes to it when
+// flagMirror is set) so tests can call r.sync directly without going through
+// yaml config or the daemon.
+func newTestRepo(t *testing.T, source, destinationName, destinationPath string) *repo {
+	t.Helper()
+
+	cacheDir := t.TempDir()
+
+	queue, err := openSyncQueue(filepath.Join(cacheDir, "syncqueue.db"), 3)
+	if err != nil {
+		t.Fatalf("opening sync queue: %v", err)
+	}
+	t.Cleanup(func() { queue.Close() })
+
+	r := &repo{
+		root:   filepath.Join(cacheDir, "repo"),
+		name:   "testrepo",
+		source: "file://" + source,
+		destinations: []destination{{
+			name:     destinationName,
+			url:      "file://" + destinationPath,
+			refspecs: defaultRefspecs,
+			enabled:  true,
+		}},
+		queue:  queue,
+		output: newLogRing(debugLogLines),
+	}
+
+	m := &mirror{repos: []*repo{r}, cacheDir: cacheDir, queue: queue}
+	r.mirror = m
+
+	return r
+}
+
+// withMirroring flips flagMirror on for the duration of a test, restoring
+// it afterward - sync() only pushes when it's set.
+func withMirroring(t *testing.T) {
+	t.Helper()
+
+	prev := *flagMirror
+	*flagMirror = true
+	t.Cleanup(func() { *flagMirror = prev })
+}
+
+func TestSyncInitialClone(t *testing.T) {
+	source := newBareRepo(t, "source")
+	seedCommit(t, source, "main", "a.txt", "hello")
+
+	dest := newBareRepo(t, "dest")
+	r := newTestRepo(t, source, "dest", dest)
+
+	if err := r.sync(SyncPull); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	out := runGit(t, r.root, "log", "--oneline", "refs/heads/main")
+	if out == "" {
+		t.Fatalf("expected cloned repo to have commits on main, got empty log")
+	}
+}
+
+func TestSyncReusesExistingCache(t *testing.T) {
+	source := newBareRepo(t, "source")
+	seedCommit(t, source, "main", "a.txt", "hello")
+
+	dest := newBareRepo(t, "dest")
+	r := newTestRepo(t, source, "dest", dest)
+
+	if err := r.sync(SyncPull); err != nil {
+		t.Fatalf("initial sync: %v", err)
+	}
+
+	// Mark the cache dir so we can tell whether a later sync wiped it.
+	marker := filepath.Join(r.root, "marker")
+	if err := writeFile(marker, "present"); err != nil {
+		t.Fatalf("writing marker: %v", err)
+	}
+
+	if err := r.sync(SyncPull); err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("expected cache dir to be reused (marker file preserved), got: %v", err)
+	}
+}
+
+func TestSyncPicksUpNewCommits(t *testing.T) {
+	source := newBareRepo(t, "source")
+	seedCommit(t, source, "main", "a.txt", "hello")
+
+	dest := newBareRepo(t, "dest")
+	r := newTestRepo(t, source, "dest", dest)
+
+	if err := r.sync(SyncPull); err != nil {
+		t.Fatalf("initial sync: %v", err)
+	}
+
+	seedCommit(t, source, "main", "b.txt", "world")
+
+	if err := r.sync(SyncPull); err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+
+	out := runGit(t, r.root, "log", "--oneline", "refs/heads/main")
+	if strings.Count(strings.TrimSpace(out), "\n") < 1 {
+		t.Fatalf("expected two commits on main after second fetch, got:\n%s", out)
+	}
+}
+
+func TestSyncForcePushesOverDivergedHistory(t *testing.T) {
+	withMirroring(t)
+
+	source := newBareRepo(t, "source")
+	seedCommit(t, source, "main", "a.txt", "hello")
+
+	dest := newBareRepo(t, "dest")
+	seedCommit(t, dest, "main", "diverged.txt", "not from source")
+
+	r := newTestRepo(t, source, "dest", dest)
+
+	if err := r.sync(SyncFull); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	sourceHead := strings.TrimSpace(runGit(t, source, "rev-parse", "main"))
+	destHead := strings.TrimSpace(runGit(t, dest, "rev-parse", "main"))
+	if sourceHead != destHead {
+		t.Fatalf("expected destination main (%s) to match source main (%s) after force push", destHead, sourceHead)
+	}
+}
+
+func TestSyncPrunesDeletedBranches(t *testing.T) {
+	withMirroring(t)
+
+	source := newBareRepo(t, "source")
+	seedCommit(t, source, "main", "a.txt", "hello")
+	seedCommit(t, source, "feature", "b.txt", "world")
+
+	dest := newBareRepo(t, "dest")
+	r := newTestRepo(t, source, "dest", dest)
+
+	if err := r.sync(SyncFull); err != nil {
+		t.Fatalf("initial sync: %v", err)
+	}
+
+	if !refs(t, dest)["refs/heads/feature"] {
+		t.Fatalf("expected destination to have refs/heads/feature after initial sync")
+	}
+
+	runGit(t, source, "branch", "-D", "feature")
+
+	if err := r.sync(SyncFull); err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+
+	if refs(t, dest)["refs/heads/feature"] {
+		t.Fatalf("expected refs/heads/feature to be pruned from destination")
+	}
+}
+
+func TestSyncPreservesFetchStateWhenPushFails(t *testing.T) {
+	withMirroring(t)
+
+	source := newBareRepo(t, "source")
+	seedCommit(t, source, "main", "a.txt", "hello")
+
+	// Not a repo at all - any push here is guaranteed to fail.
+	badDest := filepath.Join(t.TempDir(), "not-a-repo")
+	r := newTestRepo(t, source, "dest", badDest)
+
+	err := r.sync(SyncFull)
+	if err == nil {
+		t.Fatalf("expected sync to report the push failure")
+	}
+
+	out := runGit(t, r.root, "log", "--oneline", "refs/heads/main")
+	if out == "" {
+		t.Fatalf("expected fetch state to be preserved despite push failure, got empty log")
+	}
+
+	snapshot := r.status.snapshot()
+	if snapshot.lastFetch.IsZero() {
+		t.Fatalf("expected status.lastFetch to be recorded despite push failure")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SyncKind is the kind of work a SyncRequest asks for.
+type SyncKind int
+
+const (
+	SyncPull SyncKind = iota // fetch from source only
+	SyncFull                 // fetch then push
+)
+
+func (k SyncKind) String() string {
+	switch k {
+	case SyncPull:
+		return "pull"
+	case SyncFull:
+		return "full"
+	default:
+		return "unknown"
+	}
+}
+
+// SyncRequest is one unit of work on the sync queue.
+type SyncRequest struct {
+	RepoName  string
+	Kind      SyncKind
+	Attempt   int       // number of previous attempts, 0 for a fresh request
+	NotBefore time.Time // queue won't hand this out before this time
+}
+
+// backoffSchedule is how long to wait before retrying after attempt N fails,
+// indexed by attempt-1 and capped at the last entry.
+var backoffSchedule = []time.Duration{
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+	time.Hour,
+}
+
+func backoffFor(attempt int) time.Duration {
+	idx := attempt - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(backoffSchedule) {
+		idx = len(backoffSchedule) - 1
+	}
+	return backoffSchedule[idx]
+}
+
+var syncQueueBucket = []byte("syncqueue")
+
+// syncQueue is a persistent, retrying queue of SyncRequests, modeled on
+// Gitea's mirror queue. It's backed by a bolt file under the cache dir so
+// pending work survives a restart, and workers that fail a request
+// re-enqueue it with exponential backoff instead of dropping it.
+type syncQueue struct {
+	db          *bolt.DB
+	maxAttempts int
+	notify      chan struct{}
+}
+
+func openSyncQueue(path string, maxAttempts int) (*syncQueue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening sync queue db %q: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(syncQueueBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating sync queue bucket: %v", err)
+	}
+
+	return &syncQueue{
+		db:          db,
+		maxAttempts: maxAttempts,
+		notify:      make(chan struct{}, 1),
+	}, nil
+}
+
+func (q *syncQueue) Close() error {
+	return q.db.Close()
+}
+
+// Enqueue adds req to the queue, to be picked up as soon as a worker is
+// free and req.NotBefore has passed.
+func (q *syncQueue) Enqueue(req SyncRequest) error {
+	if req.NotBefore.IsZero() {
+		req.NotBefore = time.Now()
+	}
+
+	if err := q.put(req); err != nil {
+		return err
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (q *syncQueue) put(req SyncRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(syncQueueBucket).Put(syncQueueKey(req), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	q.updateDepthMetric()
+	return nil
+}
+
+// syncQueueKey sorts lexicographically by NotBefore, so a cursor walking
+// the bucket in order visits the earliest-ready request first.
+func syncQueueKey(req SyncRequest) []byte {
+	return []byte(fmt.Sprintf("%020d-%s-%d", req.NotBefore.UnixNano(), req.RepoName, req.Kind))
+}
+
+// pop removes and returns the earliest request whose NotBefore has passed,
+// if any. ok is false if the queue is empty or nothing is ready yet.
+func (q *syncQueue) pop() (req SyncRequest, ok bool, err error) {
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(syncQueueBucket)
+		c := b.Cursor()
+
+		k, v := c.First()
+		if k == nil {
+			return nil
+		}
+
+		if jsonErr := json.Unmarshal(v, &req); jsonErr != nil {
+			return jsonErr
+		}
+
+		if req.NotBefore.After(time.Now()) {
+			return nil
+		}
+
+		ok = true
+		return b.Delete(k)
+	})
+	if err != nil {
+		return SyncRequest{}, false, err
+	}
+
+	if ok {
+		q.updateDepthMetric()
+	}
+
+	return req, ok, nil
+}
+
+func (q *syncQueue) depth() (int, error) {
+	var n int
+	err := q.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(syncQueueBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+func (q *syncQueue) updateDepthMetric() {
+	n, err := q.depth()
+	if err != nil {
+		log.Printf("syncqueue: error reading depth: %v", err)
+		return
+	}
+	syncQueueDepth.Set(float64(n))
+}
+
+// run starts numWorkers goroutines popping requests off the queue and
+// passing them to handle, re-enqueuing failures with backoff up to
+// maxAttempts. It blocks until ctx is done.
+func (q *syncQueue) run(ctx context.Context, numWorkers int, handle func(SyncRequest) error) {
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.worker(ctx, handle)
+		}()
+	}
+	<-ctx.Done()
+	wg.Wait()
+}
+
+func (q *syncQueue) worker(ctx context.Context, handle func(SyncRequest) error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		req, ok, err := q.pop()
+		if err != nil {
+			log.Printf("syncqueue: error popping request: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.notify:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		syncAttemptsTotal.WithLabelValues(req.RepoName, req.Kind.String()).Inc()
+
+		if err := handle(req); err != nil {
+			syncFailuresTotal.WithLabelValues(req.RepoName, req.Kind.String()).Inc()
+			q.retry(req, err)
+		}
+	}
+}
+
+func (q *syncQueue) retry(req SyncRequest, cause error) {
+	req.Attempt++
+
+	if req.Attempt >= q.maxAttempts {
+		log.Printf("syncqueue: giving up on repo %s (%s) after %d attempts, last error: %v",
+			req.RepoName, req.Kind, req.Attempt, cause)
+		return
+	}
+
+	req.NotBefore = time.Now().Add(backoffFor(req.Attempt))
+	log.Printf("syncqueue: repo %s (%s) failed, retrying in %s (attempt %d/%d): %v",
+		req.RepoName, req.Kind, backoffFor(req.Attempt), req.Attempt+1, q.maxAttempts, cause)
+
+	if err := q.put(req); err != nil {
+		log.Printf("syncqueue: error re-enqueuing repo %s: %v", req.RepoName, err)
+	}
+}